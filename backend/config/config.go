@@ -0,0 +1,114 @@
+// Package config loads a declarative description of a backend graph from
+// TOML or YAML and instantiates it.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/errors"
+)
+
+// BackendSpec is the typed tree a TOML/YAML document decodes into. Type
+// selects the registered creator; Args holds that creator's own fields,
+// checked against the schema it registered with backend.RegisterSchema;
+// Backend nests another spec for composite backends such as "indexed".
+type BackendSpec struct {
+	Type    string                 `toml:"type" yaml:"type"`
+	Args    map[string]interface{} `toml:"args" yaml:"args"`
+	Backend *BackendSpec           `toml:"backend" yaml:"backend"`
+}
+
+// LoadTOML decodes a TOML document into a BackendSpec.
+func LoadTOML(data []byte) (*BackendSpec, error) {
+	var spec BackendSpec
+	if _, err := toml.Decode(string(data), &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// LoadYAML decodes a YAML document into a BackendSpec, rejecting unknown
+// top-level keys the same way the per-backend Args are rejected.
+func LoadYAML(data []byte) (*BackendSpec, error) {
+	var spec BackendSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// CreateFromSpec instantiates the backend graph described by spec,
+// decoding each level's Args against the schema its Type registered.
+func CreateFromSpec(spec BackendSpec) (backend.Backend, error) {
+	args, err := resolveArgs(spec)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Create(spec.Type, args)
+}
+
+// resolveArgs turns a spec's raw Args map into the typed value its
+// creator expects, recursing into Backend for composite types like
+// "indexed".
+func resolveArgs(spec BackendSpec) (interface{}, error) {
+	schema, ok := backend.SchemaFor(spec.Type)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("resolveArgs: no schema registered for backend type %q", spec.Type))
+	}
+
+	switch schema.(type) {
+	case string:
+		s, _ := spec.Args["arg"].(string)
+		return s, nil
+
+	case backend.IndexedArgs:
+		if spec.Backend == nil {
+			return nil, errors.New("resolveArgs: \"indexed\" backend requires a nested \"backend\"")
+		}
+
+		var args struct {
+			IndexDir string `json:"index_dir"`
+		}
+		if err := decodeStrict(spec.Args, &args); err != nil {
+			return nil, err
+		}
+
+		nestedArgs, err := resolveArgs(*spec.Backend)
+		if err != nil {
+			return nil, err
+		}
+
+		return backend.IndexedArgs{
+			BackendType: spec.Backend.Type,
+			BackendArg:  nestedArgs,
+			IndexDir:    args.IndexDir,
+		}, nil
+
+	default:
+		out := reflect.New(reflect.TypeOf(schema))
+		if err := decodeStrict(spec.Args, out.Interface()); err != nil {
+			return nil, err
+		}
+		return out.Elem().Interface(), nil
+	}
+}
+
+// decodeStrict decodes raw into out, rejecting any key in raw that
+// doesn't match a field of out's type.
+func decodeStrict(raw map[string]interface{}, out interface{}) error {
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
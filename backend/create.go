@@ -4,12 +4,53 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+
+	"github.com/blevesearch/bleve"
 )
 
 type BackendCreator func(args interface{}) (Backend, error)
 
+// IndexedArgs is the Create() arg shape for the "indexed" creator: it
+// nests the wrapped backend's own type/arg pair alongside the index dir.
+type IndexedArgs struct {
+	BackendType string
+	BackendArg  interface{}
+	IndexDir    string
+}
+
+// MemcachedArgs is the Create() arg shape for the "memcached" creator.
+type MemcachedArgs struct {
+	Addr   string
+	Bucket string
+}
+
 var block sync.Mutex
 var backends map[string]BackendCreator
+var schemas map[string]interface{}
+
+// RegisterSchema records a zero-value instance of the struct a creator's
+// args decode into, so the config package can type-check and reject
+// unknown keys for a backend type at parse time, before Create is ever
+// called. A schema of "" marks the legacy convention of a single bare
+// string argument (as used by "ledis"/"leveldb"/"http").
+func RegisterSchema(btype string, schema interface{}) {
+	block.Lock()
+	defer block.Unlock()
+
+	if schemas == nil {
+		schemas = map[string]interface{}{}
+	}
+	schemas[btype] = schema
+}
+
+// SchemaFor returns the schema registered for btype via RegisterSchema.
+func SchemaFor(btype string) (interface{}, bool) {
+	block.Lock()
+	defer block.Unlock()
+
+	s, ok := schemas[btype]
+	return s, ok
+}
 
 func RegisterCreator(btype string, creator BackendCreator) error {
 	block.Lock()
@@ -30,12 +71,15 @@ func RegisterCreator(btype string, creator BackendCreator) error {
 
 func Create(btype string, args interface{}) (Backend, error) {
 	block.Lock()
-	defer block.Unlock()
-
 	r, ok := backends[btype]
+	block.Unlock()
+
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("Create: no backend type \"%s\"", btype))
 	}
+	// Creators are invoked outside the lock: building a backend can do
+	// real I/O (e.g. "indexed" recursively calling Create for its nested
+	// backend), which must not happen while block is held.
 	return r(args)
 }
 
@@ -54,9 +98,13 @@ func RegisterDefault() {
 	RegisterCreator("nil", func(arg interface{}) (Backend, error) {
 		return NewNil(), nil
 	})
+	RegisterSchema("nil", struct{}{})
+
 	RegisterCreator("mem", func(arg interface{}) (Backend, error) {
 		return NewMem(), nil
 	})
+	RegisterSchema("mem", struct{}{})
+
 	RegisterCreator("ledis", func(arg interface{}) (Backend, error) {
 		dir, ok := arg.(string)
 		if !ok {
@@ -64,6 +112,17 @@ func RegisterDefault() {
 		}
 		return NewLedis(dir)
 	})
+	RegisterSchema("ledis", "")
+
+	RegisterCreator("leveldb", func(arg interface{}) (Backend, error) {
+		dir, ok := arg.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("leveldb creator: Expected string as arg, got %v", arg))
+		}
+		return NewLeveldb(dir)
+	})
+	RegisterSchema("leveldb", "")
+
 	RegisterCreator("http", func(arg interface{}) (Backend, error) {
 		url, ok := arg.(string)
 		if !ok {
@@ -71,4 +130,37 @@ func RegisterDefault() {
 		}
 		return NewHttp(url, nil), nil
 	})
+	RegisterSchema("http", "")
+
+	RegisterCreator("redis", func(arg interface{}) (Backend, error) {
+		cfg, ok := arg.(RedisConfig)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("redis creator: Expected RedisConfig as arg, got %v", arg))
+		}
+		return NewRedis(&cfg)
+	})
+	RegisterSchema("redis", RedisConfig{})
+
+	RegisterCreator("indexed", func(arg interface{}) (Backend, error) {
+		cfg, ok := arg.(IndexedArgs)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("indexed creator: Expected IndexedArgs as arg, got %v", arg))
+		}
+
+		inner, err := Create(cfg.BackendType, cfg.BackendArg)
+		if err != nil {
+			return nil, err
+		}
+		return NewIndexed(inner, cfg.IndexDir, bleve.NewIndexMapping())
+	})
+	RegisterSchema("indexed", IndexedArgs{})
+
+	RegisterCreator("memcached", func(arg interface{}) (Backend, error) {
+		spec, ok := arg.(MemcachedArgs)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("memcached creator: Expected MemcachedArgs as arg, got %v", arg))
+		}
+		return NewMemcached(spec.Addr, spec.Bucket)
+	})
+	RegisterSchema("memcached", MemcachedArgs{})
 }
\ No newline at end of file
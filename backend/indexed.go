@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/Monnoroch/golfstream/backend/queue"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+// Searchable is implemented by backends that can resolve a query to event
+// offsets, for feeding back into Read on the underlying backend.
+type Searchable interface {
+	Search(streamName string, query string, from, size int) ([]uint, error)
+}
+
+const indexedQueueSize = 4096
+const indexedQueueWorkers = 1
+
+type indexedDoc struct {
+	Stream string `json:"stream"`
+	Offset uint   `json:"offset"`
+	Data   string `json:"data"`
+}
+
+func indexedDocID(streamName string, offset uint) string {
+	return fmt.Sprintf("%s/%d", streamName, offset)
+}
+
+type indexedStreamObj struct {
+	inner BackendStream
+	back  *indexedBackend
+	name  string
+}
+
+func (self *indexedStreamObj) Add(evt stream.Event) error {
+	// Add and Len must run as one step, else two concurrent Adds can
+	// compute the same offset.
+	self.back.addLock.Lock()
+	err := self.inner.Add(evt)
+	var l uint
+	if err == nil {
+		l, err = self.inner.Len()
+	}
+	self.back.addLock.Unlock()
+	if err != nil {
+		return err
+	}
+	offset := l - 1
+
+	bs, _ := evt.([]byte)
+	name := self.name
+	if !self.back.queue.Push(func() {
+		self.back.indexEvent(name, offset, bs)
+	}) {
+		log.Println(fmt.Sprintf("indexedStreamObj.Add: WARNING: index queue full, dropping index for %s offset %d", name, offset))
+	}
+	return nil
+}
+
+func (self *indexedStreamObj) Read(afrom uint, to int) (stream.Stream, error) {
+	return self.inner.Read(afrom, to)
+}
+
+func (self *indexedStreamObj) Del(afrom uint, ato int) (bool, error) {
+	l, err := self.inner.Len()
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := self.inner.Del(afrom, ato)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	to := ato
+	if to < 0 {
+		to = int(l) + 1 + to
+	}
+
+	name := self.name
+	if !self.back.queue.Push(func() {
+		self.back.reindexDel(name, int(afrom), to, int(l))
+	}) {
+		log.Println(fmt.Sprintf("indexedStreamObj.Del: WARNING: index queue full, index for %s now out of sync", name))
+	}
+	return ok, nil
+}
+
+func (self *indexedStreamObj) Len() (uint, error) {
+	return self.inner.Len()
+}
+
+func (self *indexedStreamObj) Close() error {
+	return self.inner.Close()
+}
+
+type indexedBackend struct {
+	inner    Backend
+	index    bleve.Index
+	indexDir string
+	queue    *queue.Queue
+
+	addLock sync.Mutex
+}
+
+func (self *indexedBackend) indexEvent(streamName string, offset uint, data []byte) {
+	doc := indexedDoc{Stream: streamName, Offset: offset, Data: string(data)}
+	if err := self.index.Index(indexedDocID(streamName, offset), doc); err != nil {
+		log.Println(fmt.Sprintf("indexedBackend.indexEvent: WARNING: failed to index %s offset %d: %v", streamName, offset, err))
+	}
+}
+
+func (self *indexedBackend) deindexRange(streamName string, from, to int) {
+	for i := from; i < to; i++ {
+		if err := self.index.Delete(indexedDocID(streamName, uint(i))); err != nil {
+			log.Println(fmt.Sprintf("indexedBackend.deindexRange: WARNING: failed to deindex %s offset %d: %v", streamName, i, err))
+		}
+	}
+}
+
+// reindexDel removes the indexed docs for the cut range [from, to) of
+// streamName and renumbers the docs for the surviving [to, oldLen) tail
+// down by (to-from), so their Offset keeps matching the position Read
+// will actually find them at after the underlying Del.
+func (self *indexedBackend) reindexDel(streamName string, from, to, oldLen int) {
+	self.deindexRange(streamName, from, to)
+
+	shift := to - from
+	if shift <= 0 {
+		return
+	}
+
+	for i := to; i < oldLen; i++ {
+		oldID := indexedDocID(streamName, uint(i))
+		doc, ok, err := self.getDoc(oldID)
+		if err != nil {
+			log.Println(fmt.Sprintf("indexedBackend.reindexDel: WARNING: failed to read %s offset %d: %v", streamName, i, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		newOffset := uint(i - shift)
+		doc.Offset = newOffset
+		if err := self.index.Index(indexedDocID(streamName, newOffset), doc); err != nil {
+			log.Println(fmt.Sprintf("indexedBackend.reindexDel: WARNING: failed to renumber %s offset %d to %d: %v", streamName, i, newOffset, err))
+			continue
+		}
+		if err := self.index.Delete(oldID); err != nil {
+			log.Println(fmt.Sprintf("indexedBackend.reindexDel: WARNING: failed to drop stale %s offset %d: %v", streamName, i, err))
+		}
+	}
+}
+
+// getDoc reads back the indexedDoc stored at id, for renumbering it under
+// a different offset.
+func (self *indexedBackend) getDoc(id string) (indexedDoc, bool, error) {
+	doc, err := self.index.Document(id)
+	if err != nil {
+		return indexedDoc{}, false, err
+	}
+	if doc == nil {
+		return indexedDoc{}, false, nil
+	}
+
+	var out indexedDoc
+	for _, f := range doc.Fields {
+		switch f.Name() {
+		case "stream":
+			out.Stream = string(f.Value())
+		case "data":
+			out.Data = string(f.Value())
+		}
+	}
+	return out, true, nil
+}
+
+func (self *indexedBackend) indexedCount(streamName string) (int, error) {
+	q := bleve.NewMatchQuery(streamName)
+	q.SetField("stream")
+	req := bleve.NewSearchRequestOptions(q, 0, 0, false)
+	res, err := self.index.Search(req)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.Total), nil
+}
+
+// reconcile repairs drift between an underlying stream's Len() and how
+// many documents are indexed for it.
+func (self *indexedBackend) reconcile() error {
+	names, err := self.inner.Streams()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		s, err := self.inner.GetStream(name)
+		if err != nil {
+			return err
+		}
+
+		l, err := s.Len()
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		cnt, err := self.indexedCount(name)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		if cnt > int(l) {
+			self.deindexRange(name, int(l), cnt)
+		} else if uint(cnt) < l {
+			data, err := s.Read(uint(cnt), int(l))
+			if err != nil {
+				s.Close()
+				return err
+			}
+
+			offset := uint(cnt)
+			for {
+				evt, err := data.Next()
+				if err == stream.EOI {
+					break
+				}
+				if err != nil {
+					s.Close()
+					return err
+				}
+				bs, _ := evt.([]byte)
+				self.indexEvent(name, offset, bs)
+				offset += 1
+			}
+		}
+
+		s.Close()
+	}
+
+	return nil
+}
+
+func (self *indexedBackend) Config() (interface{}, error) {
+	innerCfg, err := self.inner.Config()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"type":      "indexed",
+		"backend":   innerCfg,
+		"index_dir": self.indexDir,
+	}, nil
+}
+
+func (self *indexedBackend) Streams() ([]string, error) {
+	return self.inner.Streams()
+}
+
+func (self *indexedBackend) GetStream(name string) (BackendStream, error) {
+	inner, err := self.inner.GetStream(name)
+	if err != nil {
+		return nil, err
+	}
+	return &indexedStreamObj{inner, self, name}, nil
+}
+
+func (self *indexedBackend) Drop() error {
+	return errors.List().
+		Add(self.inner.Drop()).
+		Add(self.index.Close()).
+		Err()
+}
+
+func (self *indexedBackend) Close() error {
+	self.queue.Close()
+	return errors.List().
+		Add(self.index.Close()).
+		Add(self.inner.Close()).
+		Err()
+}
+
+// Search runs query against the index and returns the matching event
+// offsets for streamName, for use with GetStream(streamName).Read().
+func (self *indexedBackend) Search(streamName string, query string, from, size int) ([]uint, error) {
+	sameStream := bleve.NewMatchQuery(streamName)
+	sameStream.SetField("stream")
+	sq := bleve.NewConjunctionQuery(
+		sameStream,
+		bleve.NewQueryStringQuery(query),
+	)
+	req := bleve.NewSearchRequestOptions(sq, size, from, false)
+	res, err := self.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]uint, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		doc, err := self.index.Document(hit.ID)
+		if err != nil || doc == nil {
+			continue
+		}
+		for _, f := range doc.Fields {
+			if f.Name() == "offset" {
+				if nf, ok := f.(interface{ Number() (float64, error) }); ok {
+					if n, err := nf.Number(); err == nil {
+						offsets = append(offsets, uint(n))
+					}
+				}
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// NewIndexed wraps inner so every Add is mirrored into a bleve index under
+// indexDir, making the stream searchable via Search.
+func NewIndexed(inner Backend, indexDir string, mapping *mapping.IndexMapping) (Backend, error) {
+	index, err := bleve.Open(indexDir)
+	if err != nil {
+		index, err = bleve.New(indexDir, mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	self := &indexedBackend{
+		inner:    inner,
+		index:    index,
+		indexDir: indexDir,
+		queue:    queue.New(indexedQueueSize, indexedQueueWorkers),
+	}
+
+	if err := self.reconcile(); err != nil {
+		log.Println(fmt.Sprintf("NewIndexed: WARNING: failed to reconcile index at %q: %v", indexDir, err))
+	}
+
+	return self, nil
+}
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"fmt"
+	"github.com/Monnoroch/golfstream/backend/wal"
 	"github.com/Monnoroch/golfstream/errors"
 	"github.com/Monnoroch/golfstream/stream"
 	"github.com/siddontang/ledisdb/config"
@@ -9,9 +10,12 @@ import (
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
+const ledisWalMaxSize = 64 * 1024 * 1024
+
 type ledisListStream struct {
 	db      *ledis.DB
 	key     []byte
@@ -150,16 +154,33 @@ func (self *ledisStreamObj) Del(afrom uint, ato int) (bool, error) {
 		return false, err
 	}
 
+	// The gap between LTrim and RPush below used to be a data-loss
+	// window: if RPush failed after LTrim succeeded, rest was gone for
+	// good. PlanDel makes rest durable first, MarkTrimmed confirms LTrim
+	// actually ran, so NewLedis only replays deletions that got that far.
+	token, err := self.back.wal.PlanDel(self.name, int(to), int(l), rest)
+	if err != nil {
+		return false, err
+	}
+
 	if err := self.db.LTrim(self.key, 0, from-1); err != nil {
+		self.back.wal.AbortDel(token)
 		return false, err
 	}
+	if err := self.back.wal.MarkTrimmed(token); err != nil {
+		log.Println(fmt.Sprintf("ledisStreamObj.Del: WARNING: failed to mark WAL entry %d trimmed: %v", token, err))
+	}
 
-	// TODO: if this fails, we should roll back the trim... but whatever. For now.
 	_, err = self.db.RPush(self.key, rest...)
 	if err != nil {
-		log.Println(fmt.Sprintf("ledisStreamObj.Del: WARNING: RPush failed, but Trim wasn't rolled back. Lost the data."))
+		log.Println(fmt.Sprintf("ledisStreamObj.Del: WARNING: RPush failed, will be retried from the WAL on next startup"))
+		return false, err
+	}
+
+	if err := self.back.wal.CommitDel(token); err != nil {
+		log.Println(fmt.Sprintf("ledisStreamObj.Del: WARNING: failed to commit WAL entry %d: %v", token, err))
 	}
-	return err == nil, err
+	return true, nil
 }
 
 func (self *ledisStreamObj) Len() (uint, error) {
@@ -179,10 +200,25 @@ type ledisBackend struct {
 	dirname string
 	ledis   *ledis.Ledis
 	db      *ledis.DB
+	wal     *wal.WAL
 	lock    sync.Mutex
 	data    map[string]*ledisStreamObj
 }
 
+// PlanDel, CommitDel and AbortDel implement RangeDeleter by delegating to
+// the backend's own WAL.
+func (self *ledisBackend) PlanDel(streamName string, from, to int, cut [][]byte) (uint64, error) {
+	return self.wal.PlanDel(streamName, from, to, cut)
+}
+
+func (self *ledisBackend) CommitDel(token uint64) error {
+	return self.wal.CommitDel(token)
+}
+
+func (self *ledisBackend) AbortDel(token uint64) error {
+	return self.wal.AbortDel(token)
+}
+
 func (self *ledisBackend) Config() (interface{}, error) {
 	return map[string]interface{}{
 		"type": "ledis",
@@ -227,7 +263,7 @@ func (self *ledisBackend) Drop() error {
 func (self *ledisBackend) Close() error {
 	self.data = nil
 	self.ledis.Close()
-	return nil
+	return self.wal.Close()
 }
 
 func (self *ledisBackend) release(s *ledisStreamObj) {
@@ -256,5 +292,44 @@ func NewLedis(dirname string) (Backend, error) {
 		return nil, err
 	}
 
-	return &ledisBackend{dirname, ledis, db, sync.Mutex{}, map[string]*ledisStreamObj{}}, nil
+	w, err := wal.Open(filepath.Join(dirname, "del.wal"), ledisWalMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	back := &ledisBackend{dirname, ledis, db, w, sync.Mutex{}, map[string]*ledisStreamObj{}}
+	if err := back.replayWal(); err != nil {
+		return nil, err
+	}
+	return back, nil
+}
+
+// replayWal finishes any range deletion whose LTrim was marked as done but
+// which was never committed or aborted, e.g. because the process crashed
+// between ledisStreamObj.Del's LTrim and its RPush of the surviving tail.
+// Plans that never got that far need no action: the list is intact.
+func (self *ledisBackend) replayWal() error {
+	pending, err := self.wal.Pending()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, del := range pending {
+		key := []byte(del.Stream)
+		if _, err := self.db.RPush(key, del.Cut...); err != nil {
+			log.Println(fmt.Sprintf("ledisBackend.replayWal: WARNING: failed to replay deletion for stream %q: %v", del.Stream, err))
+			failed = append(failed, del.Stream)
+			continue
+		}
+		if err := self.wal.CommitDel(del.Token); err != nil {
+			log.Println(fmt.Sprintf("ledisBackend.replayWal: WARNING: failed to commit replayed deletion for stream %q: %v", del.Stream, err))
+			failed = append(failed, del.Stream)
+		}
+	}
+
+	if len(failed) != 0 {
+		return errors.New(fmt.Sprintf("ledisBackend.replayWal: refusing to start, failed to replay pending deletions for: %v", failed))
+	}
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,453 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Each stream is stored as a run of "<streamName>/<uint64-be-index>" keys
+// between a head and tail cursor kept in a sibling "<streamName>/meta" key.
+
+func leveldbEventKey(name string, idx uint64) []byte {
+	key := make([]byte, len(name)+1+8)
+	n := copy(key, name)
+	key[n] = '/'
+	binary.BigEndian.PutUint64(key[n+1:], idx)
+	return key
+}
+
+func leveldbMetaKey(name string) []byte {
+	return []byte(name + "/meta")
+}
+
+func encodeLeveldbMeta(head, tail uint64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], head)
+	binary.BigEndian.PutUint64(buf[8:], tail)
+	return buf
+}
+
+func decodeLeveldbMeta(buf []byte) (head, tail uint64, err error) {
+	if len(buf) != 16 {
+		return 0, 0, errors.New(fmt.Sprintf("decodeLeveldbMeta: expected 16 bytes, got %d", len(buf)))
+	}
+	return binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:]), nil
+}
+
+type leveldbListStream struct {
+	db      *leveldb.DB
+	name    string
+	num     uint64
+	l       uint64
+	delLock *sync.RWMutex
+}
+
+func (self *leveldbListStream) Next() (stream.Event, error) {
+	if self.num >= self.l {
+		self.delLock.RUnlock()
+		return nil, stream.EOI
+	}
+
+	res, err := self.db.Get(leveldbEventKey(self.name, self.num), nil)
+	if err != nil {
+		self.delLock.RUnlock()
+		return nil, err
+	}
+
+	self.num += 1
+	return stream.Event(res), nil
+}
+
+type leveldbStreamObj struct {
+	db   *leveldb.DB
+	back *leveldbBackend
+	name string
+
+	delLock sync.RWMutex
+	refcnt  int
+}
+
+func (self *leveldbStreamObj) meta() (head, tail uint64, err error) {
+	buf, err := self.db.Get(leveldbMetaKey(self.name), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return decodeLeveldbMeta(buf)
+}
+
+func (self *leveldbStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("leveldbStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	// Unlike ledis/redis there's no atomic append underneath: this is a
+	// read-tail, write-event, write-meta sequence, so it needs the
+	// exclusive lock, not the shared one Read uses.
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(leveldbEventKey(self.name, tail), bs)
+	batch.Put(leveldbMetaKey(self.name), encodeLeveldbMeta(head, tail+1))
+	return self.db.Write(batch, nil)
+}
+
+func (self *leveldbStreamObj) Read(afrom uint, to int) (stream.Stream, error) {
+	from := int(afrom)
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	self.delLock.RLock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return nil, err
+	}
+	l := int(tail - head)
+
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	if err := checkRange(from, to, l, "leveldbStreamObj.Read"); err != nil {
+		return nil, err
+	}
+
+	return &leveldbListStream{self.db, self.name, head + uint64(from), head + uint64(to), &self.delLock}, nil
+}
+
+// Del only ever moves the head or tail cursor, dropping an edge range in
+// O(1); the keys themselves are reclaimed by a background compaction of
+// the abandoned range rather than being deleted inline.
+func (self *leveldbStreamObj) Del(afrom uint, ato int) (bool, error) {
+	from := int64(afrom)
+	to := int64(ato)
+	if from == to {
+		return true, nil
+	}
+
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return false, err
+	}
+	l := int64(tail - head)
+
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+
+	if from == 0 && to == l {
+		if err := self.db.Put(leveldbMetaKey(self.name), encodeLeveldbMeta(tail, tail), nil); err != nil {
+			return false, err
+		}
+		self.back.compactAsync(self.name, head, tail)
+		return tail != head, nil
+	}
+
+	if from == 0 {
+		newHead := head + uint64(to)
+		if err := self.db.Put(leveldbMetaKey(self.name), encodeLeveldbMeta(newHead, tail), nil); err != nil {
+			return false, err
+		}
+		self.back.compactAsync(self.name, head, newHead)
+		return true, nil
+	}
+
+	if to == l {
+		newTail := head + uint64(from)
+		if err := self.db.Put(leveldbMetaKey(self.name), encodeLeveldbMeta(head, newTail), nil); err != nil {
+			return false, err
+		}
+		self.back.compactAsync(self.name, newTail, tail)
+		return true, nil
+	}
+
+	return false, errors.New(fmt.Sprintf("leveldbStreamObj.Del: only edge ranges can be dropped without rewriting the list, got [%d, %d) of %d", from, to, l))
+}
+
+func (self *leveldbStreamObj) Len() (uint, error) {
+	head, tail, err := self.meta()
+	if err != nil {
+		return 0, err
+	}
+	return uint(tail - head), nil
+}
+
+func (self *leveldbStreamObj) Close() error {
+	self.back.release(self)
+	return nil
+}
+
+type leveldbBackend struct {
+	dirname string
+	db      *leveldb.DB
+
+	lock sync.Mutex
+	data map[string]*leveldbStreamObj
+}
+
+func (self *leveldbBackend) Config() (interface{}, error) {
+	return map[string]interface{}{
+		"type": "leveldb",
+		"arg":  self.dirname,
+	}, nil
+}
+
+func (self *leveldbBackend) Streams() ([]string, error) {
+	iter := self.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	seen := map[string]bool{}
+	res := []string{}
+	for iter.Next() {
+		name, ok := streamNameFromKey(iter.Key())
+		if ok && !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	return res, iter.Error()
+}
+
+func streamNameFromKey(key []byte) (string, bool) {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == '/' {
+			return string(key[:i]), true
+		}
+	}
+	return "", false
+}
+
+func (self *leveldbBackend) GetStream(name string) (BackendStream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	v, ok := self.data[name]
+	if !ok {
+		v = &leveldbStreamObj{self.db, self, name, sync.RWMutex{}, 0}
+		self.data[name] = v
+	}
+
+	v.refcnt += 1
+	return v, nil
+}
+
+// compactAsync reclaims the keys in [from, to) left behind by a head or
+// tail cursor move in the background, so Del itself stays O(1).
+func (self *leveldbBackend) compactAsync(name string, from, to uint64) {
+	if from == to {
+		return
+	}
+	go func() {
+		r := &util.Range{
+			Start: leveldbEventKey(name, from),
+			Limit: leveldbEventKey(name, to),
+		}
+		batch := new(leveldb.Batch)
+		iter := self.db.NewIterator(r, nil)
+		for iter.Next() {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+		iter.Release()
+		if batch.Len() == 0 {
+			return
+		}
+		if err := self.db.Write(batch, nil); err != nil {
+			return
+		}
+		self.db.CompactRange(*r)
+	}()
+}
+
+func (self *leveldbBackend) Drop() error {
+	iter := self.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return self.db.Write(batch, nil)
+}
+
+func (self *leveldbBackend) Close() error {
+	self.data = nil
+	return self.db.Close()
+}
+
+// Snapshot returns a read-only Backend pinned to the current state of the
+// store, so a long-running consumer sees a consistent Len() and Read()
+// range even while writers keep appending and trimming concurrently.
+func (self *leveldbBackend) Snapshot() (Backend, error) {
+	snap, err := self.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbSnapshotBackend{self.dirname, snap}, nil
+}
+
+func (self *leveldbBackend) release(s *leveldbStreamObj) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s.refcnt -= 1
+	if s.refcnt == 0 {
+		delete(self.data, s.name)
+	}
+}
+
+// leveldbSnapshotBackend is a read-only view of a leveldbBackend: Add and
+// Del are rejected, Read and Len always observe the state at the time
+// Snapshot() was taken.
+type leveldbSnapshotBackend struct {
+	dirname string
+	snap    *leveldb.Snapshot
+}
+
+func (self *leveldbSnapshotBackend) Config() (interface{}, error) {
+	return map[string]interface{}{
+		"type": "leveldb-snapshot",
+		"arg":  self.dirname,
+	}, nil
+}
+
+func (self *leveldbSnapshotBackend) Streams() ([]string, error) {
+	iter := self.snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	seen := map[string]bool{}
+	res := []string{}
+	for iter.Next() {
+		name, ok := streamNameFromKey(iter.Key())
+		if ok && !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	return res, iter.Error()
+}
+
+func (self *leveldbSnapshotBackend) GetStream(name string) (BackendStream, error) {
+	buf, err := self.snap.Get(leveldbMetaKey(name), nil)
+	head, tail := uint64(0), uint64(0)
+	if err == nil {
+		head, tail, err = decodeLeveldbMeta(buf)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+	return &leveldbSnapshotStreamObj{self.snap, name, head, tail}, nil
+}
+
+func (self *leveldbSnapshotBackend) Drop() error {
+	return errors.New("leveldbSnapshotBackend.Drop: snapshot backends are read-only")
+}
+
+func (self *leveldbSnapshotBackend) Close() error {
+	self.snap.Release()
+	return nil
+}
+
+type leveldbSnapshotStreamObj struct {
+	snap       *leveldb.Snapshot
+	name       string
+	head, tail uint64
+}
+
+func (self *leveldbSnapshotStreamObj) Add(evt stream.Event) error {
+	return errors.New("leveldbSnapshotStreamObj.Add: snapshot backends are read-only")
+}
+
+func (self *leveldbSnapshotStreamObj) Read(afrom uint, to int) (stream.Stream, error) {
+	from := int(afrom)
+	l := int(self.tail - self.head)
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+	if from == to {
+		return stream.Empty(), nil
+	}
+	if err := checkRange(from, to, l, "leveldbSnapshotStreamObj.Read"); err != nil {
+		return nil, err
+	}
+	return &leveldbSnapshotListStream{self.snap, self.name, self.head + uint64(from), self.head + uint64(to)}, nil
+}
+
+func (self *leveldbSnapshotStreamObj) Del(afrom uint, ato int) (bool, error) {
+	return false, errors.New("leveldbSnapshotStreamObj.Del: snapshot backends are read-only")
+}
+
+func (self *leveldbSnapshotStreamObj) Len() (uint, error) {
+	return uint(self.tail - self.head), nil
+}
+
+func (self *leveldbSnapshotStreamObj) Close() error {
+	return nil
+}
+
+type leveldbSnapshotListStream struct {
+	snap *leveldb.Snapshot
+	name string
+	num  uint64
+	l    uint64
+}
+
+func (self *leveldbSnapshotListStream) Next() (stream.Event, error) {
+	if self.num >= self.l {
+		return nil, stream.EOI
+	}
+
+	res, err := self.snap.Get(leveldbEventKey(self.name, self.num), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	self.num += 1
+	return stream.Event(res), nil
+}
+
+func NewLeveldb(dirname string) (Backend, error) {
+	db, err := leveldb.OpenFile(dirname, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &leveldbBackend{dirname, db, sync.Mutex{}, map[string]*leveldbStreamObj{}}, nil
+}
@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/Monnoroch/golfstream/stream"
+)
+
+func newLeveldbStream(t *testing.T, name string) (Backend, BackendStream) {
+	back, err := NewLeveldb(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLeveldb: %v", err)
+	}
+
+	s, err := back.GetStream(name)
+	if err != nil {
+		t.Fatalf("GetStream: %v", err)
+	}
+	return back, s
+}
+
+func readAll(t *testing.T, s BackendStream, from uint, to int) []string {
+	data, err := s.Read(from, to)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var res []string
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		bs, _ := evt.([]byte)
+		res = append(res, string(bs))
+	}
+	return res
+}
+
+func TestLeveldbAddReadLen(t *testing.T) {
+	back, s := newLeveldbStream(t, "s")
+	defer back.Close()
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := s.Add(stream.Event([]byte(v))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	l, err := s.Len()
+	if err != nil {
+		t.Fatalf("Len: %v", err)
+	}
+	if l != 3 {
+		t.Fatalf("expected length 3, got %d", l)
+	}
+
+	got := readAll(t, s, 0, 3)
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("expected [a b c], got %v", got)
+	}
+}
+
+func TestLeveldbDelFrontTrim(t *testing.T) {
+	back, s := newLeveldbStream(t, "s")
+	defer back.Close()
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := s.Add(stream.Event([]byte(v))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	ok, err := s.Del(0, 1)
+	if err != nil || !ok {
+		t.Fatalf("Del: ok=%v err=%v", ok, err)
+	}
+
+	got := readAll(t, s, 0, 2)
+	if len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("expected [b c], got %v", got)
+	}
+}
+
+func TestLeveldbDelTailTrim(t *testing.T) {
+	back, s := newLeveldbStream(t, "s")
+	defer back.Close()
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := s.Add(stream.Event([]byte(v))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	ok, err := s.Del(2, 3)
+	if err != nil || !ok {
+		t.Fatalf("Del: ok=%v err=%v", ok, err)
+	}
+
+	got := readAll(t, s, 0, 2)
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("expected [a b], got %v", got)
+	}
+}
+
+func TestLeveldbDelFullClear(t *testing.T) {
+	back, s := newLeveldbStream(t, "s")
+	defer back.Close()
+
+	for _, v := range []string{"a", "b"} {
+		if err := s.Add(stream.Event([]byte(v))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	ok, err := s.Del(0, -1)
+	if err != nil || !ok {
+		t.Fatalf("Del: ok=%v err=%v", ok, err)
+	}
+
+	l, err := s.Len()
+	if err != nil {
+		t.Fatalf("Len: %v", err)
+	}
+	if l != 0 {
+		t.Fatalf("expected length 0, got %d", l)
+	}
+}
+
+func TestLeveldbDelMiddleRangeRejected(t *testing.T) {
+	back, s := newLeveldbStream(t, "s")
+	defer back.Close()
+
+	for _, v := range []string{"a", "b", "c"} {
+		if err := s.Add(stream.Event([]byte(v))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	if _, err := s.Del(1, 2); err == nil {
+		t.Fatalf("expected Del of a non-edge range to be rejected")
+	}
+}
@@ -0,0 +1,328 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"github.com/couchbase/gomemcached/client"
+)
+
+// The memcached backend keeps a "<streamName>/<index>" layout like
+// leveldbBackend's, with the uint64 big-endian index written as 16 hex
+// digits, but Read(from, -1) is served by a per-stream UPR (DCP) change
+// feed instead of polling.
+
+func memcachedEventKey(name string, idx uint64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, idx)
+	return fmt.Sprintf("%s/%x", name, buf)
+}
+
+func memcachedMetaKey(name string) string {
+	return name + "/meta"
+}
+
+// memcachedChangeStream adapts a channel fed by an UPR consumer goroutine
+// to the pull-based stream.Stream interface; it never returns stream.EOI
+// on its own, only when the goroutine stops feeding it (backend Close or
+// a consumer Close of this stream).
+type memcachedChangeStream struct {
+	ch   chan stream.Event
+	stop chan struct{}
+	once sync.Once
+}
+
+func (self *memcachedChangeStream) Next() (stream.Event, error) {
+	select {
+	case evt, ok := <-self.ch:
+		if !ok {
+			return nil, stream.EOI
+		}
+		return evt, nil
+	case <-self.stop:
+		return nil, stream.EOI
+	}
+}
+
+func (self *memcachedChangeStream) Close() {
+	self.once.Do(func() { close(self.stop) })
+}
+
+// memcachedListStream is the pull-based counterpart used for bounded
+// Read(from, to) ranges, mirroring leveldbListStream.
+type memcachedListStream struct {
+	conn    *client.Client
+	name    string
+	num     uint64
+	l       uint64
+	delLock *sync.RWMutex
+}
+
+func (self *memcachedListStream) Next() (stream.Event, error) {
+	if self.num >= self.l {
+		self.delLock.RUnlock()
+		return nil, stream.EOI
+	}
+
+	res, err := self.conn.Get(memcachedEventKey(self.name, self.num))
+	if err != nil {
+		self.delLock.RUnlock()
+		return nil, err
+	}
+
+	self.num += 1
+	return stream.Event(res.Body), nil
+}
+
+type memcachedStreamObj struct {
+	conn *client.Client
+	back *memcachedBackend
+	name string
+
+	delLock sync.RWMutex
+	refcnt  int
+}
+
+func (self *memcachedStreamObj) meta() (head, tail uint64, err error) {
+	res, err := self.conn.Get(memcachedMetaKey(self.name))
+	if err == client.ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(res.Body) != 16 {
+		return 0, 0, errors.New(fmt.Sprintf("memcachedStreamObj.meta: expected 16 byte meta value, got %d", len(res.Body)))
+	}
+	return binary.BigEndian.Uint64(res.Body[:8]), binary.BigEndian.Uint64(res.Body[8:]), nil
+}
+
+func (self *memcachedStreamObj) putMeta(head, tail uint64) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], head)
+	binary.BigEndian.PutUint64(buf[8:], tail)
+	return self.conn.Set(memcachedMetaKey(self.name), buf)
+}
+
+func (self *memcachedStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("memcachedStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	// Unlike ledis/redis there's no atomic append underneath: this is a
+	// read-tail, write-event, write-meta sequence, so it needs the
+	// exclusive lock, not the shared one Read uses.
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return err
+	}
+
+	if err := self.conn.Set(memcachedEventKey(self.name, tail), bs); err != nil {
+		return err
+	}
+	return self.putMeta(head, tail+1)
+}
+
+func (self *memcachedStreamObj) Read(afrom uint, to int) (stream.Stream, error) {
+	if to < 0 && to != -1 {
+		return nil, errors.New("memcachedStreamObj.Read: only -1 is supported as an open-ended 'to'")
+	}
+
+	if to == -1 {
+		return self.back.tail(self.name, afrom)
+	}
+
+	from := int(afrom)
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	self.delLock.RLock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return nil, err
+	}
+	l := int(tail - head)
+
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	if err := checkRange(from, to, l, "memcachedStreamObj.Read"); err != nil {
+		return nil, err
+	}
+
+	return &memcachedListStream{self.conn, self.name, head + uint64(from), head + uint64(to), &self.delLock}, nil
+}
+
+// Del only ever moves the head or tail cursor, same as leveldbStreamObj.Del;
+// the abandoned keys are left for the bucket's own expiry/compaction.
+func (self *memcachedStreamObj) Del(afrom uint, ato int) (bool, error) {
+	from := int64(afrom)
+	to := int64(ato)
+	if from == to {
+		return true, nil
+	}
+
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	head, tail, err := self.meta()
+	if err != nil {
+		return false, err
+	}
+	l := int64(tail - head)
+
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+
+	if from == 0 && to == l {
+		if err := self.putMeta(tail, tail); err != nil {
+			return false, err
+		}
+		return tail != head, nil
+	}
+
+	if from == 0 {
+		return true, self.putMeta(head+uint64(to), tail)
+	}
+
+	if to == l {
+		return true, self.putMeta(head, head+uint64(from))
+	}
+
+	return false, errors.New(fmt.Sprintf("memcachedStreamObj.Del: only edge ranges can be dropped, got [%d, %d) of %d", from, to, l))
+}
+
+func (self *memcachedStreamObj) Len() (uint, error) {
+	head, tail, err := self.meta()
+	if err != nil {
+		return 0, err
+	}
+	return uint(tail - head), nil
+}
+
+func (self *memcachedStreamObj) Close() error {
+	self.back.release(self)
+	return nil
+}
+
+type memcachedBackend struct {
+	conn   *client.Client
+	bucket string
+
+	lock sync.Mutex
+	data map[string]*memcachedStreamObj
+}
+
+func (self *memcachedBackend) Config() (interface{}, error) {
+	return map[string]interface{}{
+		"type": "memcached",
+		"arg":  self.bucket,
+	}, nil
+}
+
+func (self *memcachedBackend) Streams() ([]string, error) {
+	return nil, errors.New("memcachedBackend.Streams: not supported, memcached has no key enumeration")
+}
+
+func (self *memcachedBackend) GetStream(name string) (BackendStream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	v, ok := self.data[name]
+	if !ok {
+		v = &memcachedStreamObj{self.conn, self, name, sync.RWMutex{}, 0}
+		self.data[name] = v
+	}
+
+	v.refcnt += 1
+	return v, nil
+}
+
+// tail starts a new UPR feed and consumer goroutine for name on every call
+// and returns a memcachedChangeStream fed by it, skipping ahead to afrom the
+// way a new consumer would expect Read(afrom, -1) to behave.
+func (self *memcachedBackend) tail(name string, afrom uint) (stream.Stream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	cs := &memcachedChangeStream{
+		ch:   make(chan stream.Event, 64),
+		stop: make(chan struct{}),
+	}
+
+	feed, err := self.conn.StartUprFeed(name, int64(afrom))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := name + "/"
+	metaKey := memcachedMetaKey(name)
+	go func() {
+		defer feed.Close()
+		for {
+			select {
+			case evt, ok := <-feed.C:
+				if !ok {
+					close(cs.ch)
+					return
+				}
+				key := string(evt.Key)
+				if key == metaKey || !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				select {
+				case cs.ch <- stream.Event(evt.Value):
+				case <-cs.stop:
+					return
+				}
+			case <-cs.stop:
+				return
+			}
+		}
+	}()
+
+	return cs, nil
+}
+
+func (self *memcachedBackend) Drop() error {
+	return errors.New("memcachedBackend.Drop: not supported, flush the bucket out of band")
+}
+
+func (self *memcachedBackend) Close() error {
+	self.data = nil
+	return self.conn.Close()
+}
+
+func (self *memcachedBackend) release(s *memcachedStreamObj) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s.refcnt -= 1
+	if s.refcnt == 0 {
+		delete(self.data, s.name)
+	}
+}
+
+func NewMemcached(addr, bucket string) (Backend, error) {
+	conn, err := client.Connect(addr, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memcachedBackend{conn, bucket, sync.Mutex{}, map[string]*memcachedStreamObj{}}, nil
+}
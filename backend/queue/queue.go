@@ -0,0 +1,51 @@
+// Package queue is a small bounded, in-memory work queue.
+package queue
+
+import "sync"
+
+// Job is a unit of work handed to a Queue.
+type Job func()
+
+// Queue runs Jobs on a fixed pool of worker goroutines, in the order they
+// were pushed, dropping new jobs once the backlog is full.
+type Queue struct {
+	jobs chan Job
+	wg   sync.WaitGroup
+}
+
+// New starts a Queue with the given backlog size and number of workers.
+func New(bufSize, workers int) *Queue {
+	self := &Queue{jobs: make(chan Job, bufSize)}
+
+	for i := 0; i < workers; i++ {
+		self.wg.Add(1)
+		go self.worker()
+	}
+
+	return self
+}
+
+func (self *Queue) worker() {
+	defer self.wg.Done()
+	for job := range self.jobs {
+		job()
+	}
+}
+
+// Push enqueues job and returns true, or returns false without running it
+// if the backlog is full.
+func (self *Queue) Push(job Job) bool {
+	select {
+	case self.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the backlog and waits for it to drain. A Push after Close
+// panics.
+func (self *Queue) Close() {
+	close(self.jobs)
+	self.wg.Wait()
+}
@@ -0,0 +1,17 @@
+package backend
+
+// RangeDeleter is implemented by backends whose Del can't perform a
+// middle-of-the-list deletion atomically against their underlying store
+// (e.g. ledisBackend and redisBackend, which trim then re-append the
+// surviving tail) and therefore guard that gap with a WAL. PlanDel must be
+// durable before the destructive step starts; CommitDel or AbortDel must
+// follow once the outcome of that step is known. On startup the WAL-backed
+// implementations replay only plans whose destructive step was also marked
+// as started (wal.WAL.MarkTrimmed), which their own Del does; this interface
+// has no method for that mark, so a plan left unresolved through it alone
+// is not replayed.
+type RangeDeleter interface {
+	PlanDel(streamName string, from, to int, cut [][]byte) (token uint64, err error)
+	CommitDel(token uint64) error
+	AbortDel(token uint64) error
+}
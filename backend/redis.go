@@ -0,0 +1,497 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Monnoroch/golfstream/backend/wal"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"github.com/go-redis/redis/v8"
+)
+
+const redisWalMaxSize = 64 * 1024 * 1024
+
+// RedisConfig describes how to connect to a Redis deployment backing a
+// redisBackend. Exactly one of the three modes is used, selected by Mode.
+type RedisConfig struct {
+	// Mode is one of "single", "sentinel" or "cluster".
+	Mode string
+
+	// Addrs is host:port for "single" and "cluster", and the list of
+	// sentinel addresses for "sentinel".
+	Addrs []string
+
+	// MasterName is the sentinel master name, required when Mode is "sentinel".
+	MasterName string
+
+	Password string
+	DB       int
+
+	TLS *tls.Config
+
+	// WALPath, if set, WAL-protects Del's middle-range trim/rpush gap
+	// the same way ledisBackend does. Left empty, Del falls back to the
+	// old best-effort behavior.
+	WALPath string
+
+	// KeyPrefix namespaces every key this backend touches, so Drop only
+	// ever clears its own streams even when the DB/cluster is shared.
+	// Defaults to "golfstream:" when empty.
+	KeyPrefix string
+}
+
+func (self *RedisConfig) keyPrefix() string {
+	if self.KeyPrefix != "" {
+		return self.KeyPrefix
+	}
+	return "golfstream:"
+}
+
+func (self *RedisConfig) client() (redis.UniversalClient, error) {
+	switch self.Mode {
+	case "", "single":
+		if len(self.Addrs) != 1 {
+			return nil, errors.New(fmt.Sprintf("RedisConfig.client: single mode expects exactly one address, got %v", self.Addrs))
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:      self.Addrs[0],
+			Password:  self.Password,
+			DB:        self.DB,
+			TLSConfig: self.TLS,
+		}), nil
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    self.MasterName,
+			SentinelAddrs: self.Addrs,
+			Password:      self.Password,
+			DB:            self.DB,
+			TLSConfig:     self.TLS,
+		}), nil
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     self.Addrs,
+			Password:  self.Password,
+			TLSConfig: self.TLS,
+		}), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("RedisConfig.client: unknown mode %q", self.Mode))
+	}
+}
+
+// ParseRedisURL parses a "redis://[:password@]host:port[/db]" DSN into a
+// single-node RedisConfig, for callers that only have a DSN handy.
+func ParseRedisURL(dsn string) (*RedisConfig, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, errors.New(fmt.Sprintf("ParseRedisURL: unsupported scheme %q", u.Scheme))
+	}
+
+	db := 0
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		db, err = strconv.Atoi(path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ParseRedisURL: bad db number %q", path))
+		}
+	}
+
+	password := ""
+	if u.User != nil {
+		password, _ = u.User.Password()
+	}
+
+	cfg := &RedisConfig{
+		Mode:     "single",
+		Addrs:    []string{u.Host},
+		Password: password,
+		DB:       db,
+	}
+	if u.Scheme == "rediss" {
+		cfg.TLS = &tls.Config{}
+	}
+	return cfg, nil
+}
+
+type redisListStream struct {
+	client  redis.UniversalClient
+	ctx     context.Context
+	key     string
+	num     int64
+	l       int64
+	delLock *sync.RWMutex
+}
+
+func (self *redisListStream) Next() (stream.Event, error) {
+	if self.num >= self.l {
+		self.delLock.RUnlock()
+		return nil, stream.EOI
+	}
+
+	res, err := self.client.LIndex(self.ctx, self.key, self.num).Bytes()
+	if err != nil {
+		self.delLock.RUnlock()
+		return nil, err
+	}
+
+	self.num += 1
+	return stream.Event(res), nil
+}
+
+type redisStreamObj struct {
+	client redis.UniversalClient
+	ctx    context.Context
+	back   *redisBackend
+	name   string
+	key    string
+
+	delLock sync.RWMutex
+
+	refcnt int
+}
+
+func (self *redisStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("redisStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	return self.client.RPush(self.ctx, self.key, bs).Err()
+}
+
+func (self *redisStreamObj) Read(afrom uint, to int) (stream.Stream, error) {
+	from := int(afrom)
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	self.delLock.RLock()
+
+	al, err := self.client.LLen(self.ctx, self.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	l := int(al)
+
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	if err := checkRange(from, to, l, "redisStreamObj.Read"); err != nil {
+		return nil, err
+	}
+
+	return &redisListStream{self.client, self.ctx, self.key, int64(from), int64(to), &self.delLock}, nil
+}
+
+func (self *redisStreamObj) Del(afrom uint, ato int) (bool, error) {
+	from := int64(afrom)
+	to := int64(ato)
+	if from == to {
+		return true, nil
+	}
+
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	if from == 0 && to == -1 {
+		cnt, err := self.client.Del(self.ctx, self.key).Result()
+		if err != nil {
+			return false, err
+		}
+		return cnt != 0, nil
+	}
+
+	l, err := self.client.LLen(self.ctx, self.key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if to < 0 {
+		to = l + 1 + to
+	}
+	if from < 0 {
+		from = l + 1 + from
+	}
+
+	if from == 0 && to == l {
+		cnt, err := self.client.Del(self.ctx, self.key).Result()
+		if err != nil {
+			return false, err
+		}
+		return cnt != 0, nil
+	}
+
+	if from == 0 {
+		err := self.client.LTrim(self.ctx, self.key, to, l).Err()
+		return err == nil, err
+	}
+
+	if to == l {
+		err := self.client.LTrim(self.ctx, self.key, 0, from-1).Err()
+		return err == nil, err
+	}
+
+	if err := checkRange(int(from), int(to), int(l), "redisStreamObj.Del"); err != nil {
+		return false, err
+	}
+
+	rest, err := self.client.LRange(self.ctx, self.key, to, l).Result()
+	if err != nil {
+		return false, err
+	}
+	cut := make([][]byte, len(rest))
+	for i, v := range rest {
+		cut[i] = []byte(v)
+	}
+
+	// WAL-protected when configured via RedisConfig.WALPath, same as
+	// ledisStreamObj.Del.
+	var token uint64
+	if self.back.wal != nil {
+		token, err = self.back.wal.PlanDel(self.name, int(to), int(l), cut)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err := self.client.LTrim(self.ctx, self.key, 0, from-1).Err(); err != nil {
+		if self.back.wal != nil {
+			self.back.wal.AbortDel(token)
+		}
+		return false, err
+	}
+	if self.back.wal != nil {
+		if err := self.back.wal.MarkTrimmed(token); err != nil {
+			log.Println(fmt.Sprintf("redisStreamObj.Del: WARNING: failed to mark WAL entry %d trimmed: %v", token, err))
+		}
+	}
+
+	args := make([]interface{}, len(rest))
+	for i, v := range rest {
+		args[i] = v
+	}
+	if err := self.client.RPush(self.ctx, self.key, args...).Err(); err != nil {
+		return false, err
+	}
+
+	if self.back.wal != nil {
+		if err := self.back.wal.CommitDel(token); err != nil {
+			log.Println(fmt.Sprintf("redisStreamObj.Del: WARNING: failed to commit WAL entry %d: %v", token, err))
+		}
+	}
+	return true, nil
+}
+
+func (self *redisStreamObj) Len() (uint, error) {
+	l, err := self.client.LLen(self.ctx, self.key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(l), nil
+}
+
+func (self *redisStreamObj) Close() error {
+	self.back.release(self)
+	return nil
+}
+
+type redisBackend struct {
+	client redis.UniversalClient
+	ctx    context.Context
+	cfg    *RedisConfig
+	wal    *wal.WAL
+
+	lock sync.Mutex
+	data map[string]*redisStreamObj
+}
+
+// streamSetKey is the key of the set tracking every stream name this
+// backend owns, and keyFor is the key of a given stream's list. Both are
+// namespaced by cfg.KeyPrefix so Drop never touches keys outside it.
+func (self *redisBackend) streamSetKey() string {
+	return self.cfg.keyPrefix() + "streams"
+}
+
+func (self *redisBackend) keyFor(name string) string {
+	return self.cfg.keyPrefix() + name
+}
+
+// PlanDel, CommitDel and AbortDel implement RangeDeleter, delegating to
+// the backend's WAL if one was configured via RedisConfig.WALPath.
+func (self *redisBackend) PlanDel(streamName string, from, to int, cut [][]byte) (uint64, error) {
+	if self.wal == nil {
+		return 0, errors.New("redisBackend.PlanDel: no WALPath configured for this backend")
+	}
+	return self.wal.PlanDel(streamName, from, to, cut)
+}
+
+func (self *redisBackend) CommitDel(token uint64) error {
+	if self.wal == nil {
+		return errors.New("redisBackend.CommitDel: no WALPath configured for this backend")
+	}
+	return self.wal.CommitDel(token)
+}
+
+func (self *redisBackend) AbortDel(token uint64) error {
+	if self.wal == nil {
+		return errors.New("redisBackend.AbortDel: no WALPath configured for this backend")
+	}
+	return self.wal.AbortDel(token)
+}
+
+func (self *redisBackend) Config() (interface{}, error) {
+	return map[string]interface{}{
+		"type": "redis",
+		"arg":  self.cfg,
+	}, nil
+}
+
+func (self *redisBackend) Streams() ([]string, error) {
+	return self.client.SMembers(self.ctx, self.streamSetKey()).Result()
+}
+
+func (self *redisBackend) GetStream(name string) (BackendStream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	v, ok := self.data[name]
+	if !ok {
+		if err := self.client.SAdd(self.ctx, self.streamSetKey(), name).Err(); err != nil {
+			return nil, err
+		}
+		v = &redisStreamObj{self.client, self.ctx, self, name, self.keyFor(name), sync.RWMutex{}, 0}
+		self.data[name] = v
+	}
+
+	v.refcnt += 1
+	return v, nil
+}
+
+// Drop removes only this backend's own keys (its stream lists and the set
+// tracking their names), not the whole DB/cluster, so other tenants
+// sharing it are unaffected. It also clears the WAL if one is configured,
+// so a dropped backend doesn't resurrect pre-Drop deletions from stale
+// WAL entries the next time WALPath is opened.
+func (self *redisBackend) Drop() error {
+	names, err := self.client.SMembers(self.ctx, self.streamSetKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		keys = append(keys, self.keyFor(name))
+	}
+	keys = append(keys, self.streamSetKey())
+
+	if err := self.client.Del(self.ctx, keys...).Err(); err != nil {
+		return err
+	}
+
+	if self.wal != nil {
+		return self.wal.Compact()
+	}
+	return nil
+}
+
+func (self *redisBackend) Close() error {
+	self.data = nil
+	if self.wal != nil {
+		if err := self.wal.Close(); err != nil {
+			return err
+		}
+	}
+	return self.client.Close()
+}
+
+func (self *redisBackend) release(s *redisStreamObj) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s.refcnt -= 1
+	if s.refcnt == 0 {
+		delete(self.data, s.name)
+	}
+}
+
+func NewRedis(cfg *RedisConfig) (Backend, error) {
+	client, err := cfg.client()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	var w *wal.WAL
+	if cfg.WALPath != "" {
+		w, err = wal.Open(cfg.WALPath, redisWalMaxSize)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	back := &redisBackend{client, context.Background(), cfg, w, sync.Mutex{}, map[string]*redisStreamObj{}}
+	if w != nil {
+		if err := back.replayWal(); err != nil {
+			return nil, err
+		}
+	}
+	return back, nil
+}
+
+// replayWal finishes any range deletion that was planned but never
+// committed or aborted, e.g. because the process crashed between
+// redisStreamObj.Del's LTrim and its RPush of the surviving tail.
+func (self *redisBackend) replayWal() error {
+	pending, err := self.wal.Pending()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, del := range pending {
+		args := make([]interface{}, len(del.Cut))
+		for i, v := range del.Cut {
+			args[i] = v
+		}
+		if err := self.client.RPush(self.ctx, self.keyFor(del.Stream), args...).Err(); err != nil {
+			log.Println(fmt.Sprintf("redisBackend.replayWal: WARNING: failed to replay deletion for stream %q: %v", del.Stream, err))
+			failed = append(failed, del.Stream)
+			continue
+		}
+		if err := self.wal.CommitDel(del.Token); err != nil {
+			log.Println(fmt.Sprintf("redisBackend.replayWal: WARNING: failed to commit replayed deletion for stream %q: %v", del.Stream, err))
+			failed = append(failed, del.Stream)
+		}
+	}
+
+	if len(failed) != 0 {
+		return errors.New(fmt.Sprintf("redisBackend.replayWal: refusing to start, failed to replay pending deletions for: %v", failed))
+	}
+	return nil
+}
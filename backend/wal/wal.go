@@ -0,0 +1,227 @@
+// Package wal is a small write-ahead log for destructive multi-step
+// operations that can't be made atomic against the underlying store.
+package wal
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/Monnoroch/golfstream/errors"
+)
+
+type recordKind byte
+
+const (
+	kindPlan recordKind = iota + 1
+	kindTrimmed
+	kindCommit
+	kindAbort
+)
+
+// DelRecord is the payload of a planned range deletion: the events in
+// [From, To) of Stream that must be replayed back in if the destructive
+// step they guard doesn't finish. Token identifies the plan, so a caller
+// that replays Cut can CommitDel it once the replay actually lands.
+type DelRecord struct {
+	Token  uint64
+	Stream string
+	From   int
+	To     int
+	Cut    [][]byte
+}
+
+type record struct {
+	Kind  recordKind
+	Token uint64
+	Del   DelRecord
+}
+
+// WAL is a bounded append-only log file shared by a single backend
+// instance; every write is fsync'd before returning.
+type WAL struct {
+	lock    sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	nextTok uint64
+	maxSize int64
+	pending int
+}
+
+// Open opens (creating if necessary) the log file at path. maxSize bounds
+// how large the log is allowed to grow: once it reaches maxSize every
+// further append (PlanDel, MarkTrimmed, CommitDel, AbortDel) fails until
+// Compact truncates it. Callers are expected to call Pending on startup and
+// resolve each entry it returns with CommitDel or AbortDel.
+func Open(path string, maxSize int64) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{f: f, w: bufio.NewWriter(f), maxSize: maxSize}, nil
+}
+
+func (self *WAL) append(r record) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if fi, err := self.f.Stat(); err == nil && self.maxSize > 0 && fi.Size() >= self.maxSize {
+		return errors.New(fmt.Sprintf("WAL.append: log at %q is full, call Compact", self.f.Name()))
+	}
+
+	if err := gob.NewEncoder(self.w).Encode(r); err != nil {
+		return err
+	}
+	if err := self.w.Flush(); err != nil {
+		return err
+	}
+	return self.f.Sync()
+}
+
+// PlanDel durably records that events [from, to) of streamName are about
+// to be cut from the list but must be restored if the op doesn't commit,
+// and returns a token identifying the plan. The destructive step itself
+// hasn't started yet: replay must not act on a plan alone, only once
+// MarkTrimmed confirms it.
+func (self *WAL) PlanDel(streamName string, from, to int, cut [][]byte) (uint64, error) {
+	self.lock.Lock()
+	self.nextTok += 1
+	token := self.nextTok
+	self.lock.Unlock()
+
+	rec := record{Kind: kindPlan, Token: token, Del: DelRecord{Stream: streamName, From: from, To: to, Cut: cut}}
+	if err := self.append(rec); err != nil {
+		return 0, err
+	}
+
+	self.lock.Lock()
+	self.pending += 1
+	self.lock.Unlock()
+	return token, nil
+}
+
+// MarkTrimmed durably records that the destructive step guarded by token
+// has actually started, so a crash from here on must be replayed by
+// finishing the operation rather than treated as a no-op.
+func (self *WAL) MarkTrimmed(token uint64) error {
+	return self.append(record{Kind: kindTrimmed, Token: token})
+}
+
+// CommitDel marks the plan identified by token as completed: its Cut data
+// has safely landed back in the underlying store.
+func (self *WAL) CommitDel(token uint64) error {
+	if err := self.append(record{Kind: kindCommit, Token: token}); err != nil {
+		return err
+	}
+	self.drain()
+	return nil
+}
+
+// AbortDel marks the plan identified by token as abandoned: the
+// destructive step it guarded never happened, so there's nothing to
+// replay for it.
+func (self *WAL) AbortDel(token uint64) error {
+	if err := self.append(record{Kind: kindAbort, Token: token}); err != nil {
+		return err
+	}
+	self.drain()
+	return nil
+}
+
+// drain compacts the log once every plan it holds has been resolved, so
+// a long-running process doesn't grow it without bound.
+func (self *WAL) drain() {
+	self.lock.Lock()
+	self.pending -= 1
+	empty := self.pending <= 0
+	self.lock.Unlock()
+
+	if !empty {
+		return
+	}
+	if err := self.Compact(); err != nil {
+		log.Println(fmt.Sprintf("WAL.drain: WARNING: failed to compact %q: %v", self.f.Name(), err))
+	}
+}
+
+// Pending replays the log and returns every DelRecord whose destructive
+// step was confirmed started (MarkTrimmed) but never committed or
+// aborted, in the order they were planned. A plan with no matching
+// MarkTrimmed means the crash happened before the destructive step ran,
+// so the original list is intact and there's nothing to replay for it.
+func (self *WAL) Pending() ([]DelRecord, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, err := self.f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	plans := map[uint64]DelRecord{}
+	trimmed := map[uint64]bool{}
+	order := []uint64{}
+	br := bufio.NewReader(self.f)
+	for {
+		// Each record was written by its own gob.Encoder and so carries its
+		// own type definitions; it needs its own Decoder to be read back.
+		var r record
+		if err := gob.NewDecoder(br).Decode(&r); err != nil {
+			break
+		}
+
+		switch r.Kind {
+		case kindPlan:
+			plans[r.Token] = r.Del
+			order = append(order, r.Token)
+			if r.Token > self.nextTok {
+				self.nextTok = r.Token
+			}
+		case kindTrimmed:
+			trimmed[r.Token] = true
+		case kindCommit, kindAbort:
+			delete(plans, r.Token)
+			delete(trimmed, r.Token)
+		}
+	}
+
+	if _, err := self.f.Seek(0, os.SEEK_END); err != nil {
+		return nil, err
+	}
+
+	res := make([]DelRecord, 0, len(plans))
+	for _, tok := range order {
+		if del, ok := plans[tok]; ok && trimmed[tok] {
+			del.Token = tok
+			res = append(res, del)
+		}
+	}
+
+	self.pending = len(res)
+	return res, nil
+}
+
+// Compact truncates the log once the caller has resolved every entry
+// returned by Pending, so it doesn't grow without bound.
+func (self *WAL) Compact() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := self.f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	self.pending = 0
+	return nil
+}
+
+func (self *WAL) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.f.Close()
+}
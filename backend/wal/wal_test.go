@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func open(t *testing.T) *WAL {
+	w, err := Open(filepath.Join(t.TempDir(), "del.wal"), 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return w
+}
+
+func TestPendingEmptyAfterOpen(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending entries, got %v", pending)
+	}
+}
+
+func TestPendingSkipsUntrimmedPlan(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	if _, err := w.PlanDel("s", 1, 2, [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("PlanDel: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("plan with no MarkTrimmed must not be replayed, got %v", pending)
+	}
+}
+
+func TestPendingReturnsTrimmedUncommittedPlan(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	token, err := w.PlanDel("s", 1, 2, [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("PlanDel: %v", err)
+	}
+	if err := w.MarkTrimmed(token); err != nil {
+		t.Fatalf("MarkTrimmed: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Stream != "s" {
+		t.Fatalf("expected one pending entry for stream s, got %v", pending)
+	}
+}
+
+func TestCommitDelClearsPending(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	token, err := w.PlanDel("s", 1, 2, [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("PlanDel: %v", err)
+	}
+	if err := w.MarkTrimmed(token); err != nil {
+		t.Fatalf("MarkTrimmed: %v", err)
+	}
+	if err := w.CommitDel(token); err != nil {
+		t.Fatalf("CommitDel: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending entries after commit, got %v", pending)
+	}
+}
+
+func TestAbortDelClearsPending(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	token, err := w.PlanDel("s", 1, 2, [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("PlanDel: %v", err)
+	}
+	if err := w.AbortDel(token); err != nil {
+		t.Fatalf("AbortDel: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending entries after abort, got %v", pending)
+	}
+}
+
+func TestCommitDelCompactsOnceDrained(t *testing.T) {
+	w := open(t)
+	defer w.Close()
+
+	token, err := w.PlanDel("s", 1, 2, [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("PlanDel: %v", err)
+	}
+	if err := w.MarkTrimmed(token); err != nil {
+		t.Fatalf("MarkTrimmed: %v", err)
+	}
+	if err := w.CommitDel(token); err != nil {
+		t.Fatalf("CommitDel: %v", err)
+	}
+
+	fi, err := w.f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected log to be compacted once drained, got size %d", fi.Size())
+	}
+}